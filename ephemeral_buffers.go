@@ -9,68 +9,262 @@ package ephemeral_buffers
 import (
 	"bytes"
 	"context"
+	"errors"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 )
 
+// metricsNamespace is the Prometheus namespace used for all metrics
+// exported by a Pool, e.g. ephemeral_buffers_buffers_in_use.
+const metricsNamespace = "ephemeral_buffers"
+
+// poolInstanceSeq assigns each metrics-enabled Pool a unique "pool" label
+// value, so that multiple Pools can share a single prometheus.Registerer
+// without colliding on identical metric names.
+var poolInstanceSeq uint64
+
+func nextPoolInstanceID() string {
+	return strconv.FormatUint(atomic.AddUint64(&poolInstanceSeq, 1), 10)
+}
+
+// ErrPoolFreed is returned by AcquireContext() when the Pool is Free()d
+// while a caller is waiting for a Buffer to become available.
+var ErrPoolFreed = errors.New("ephemeral_buffers: pool has been freed")
+
+// Defaults applied by MonitorOptions.withDefaults() for any field left at
+// its zero value.
+const (
+	defaultWarnAfter    = 100 * time.Millisecond
+	defaultKillAfter    = 30 * time.Second
+	defaultPollInterval = 1 * time.Second
+)
+
+// MonitorOptions configures poolMonitor's stuck-buffer detection.
+// A Buffer held past WarnAfter is logged, and OnStuck (if set) is called
+// with the tag, how long it has been held, and the stack captured when it
+// was Acquire()d, so operators can locate the leak. A Buffer held past
+// KillAfter is forcibly reclaimed, racing any Release() the original caller
+// might issue around the same time; only whichever of the two wins the claim
+// frees the Buffer's slot in the Pool, so it is never double-released. When
+// the reclaim wins, the Buffer stays claimed for good (a later Release() of
+// it is a no-op) and a fresh Buffer of the same size goes back into the Pool
+// in its place. PollInterval controls how often buffers are
+// checked. The zero value of MonitorOptions uses the package defaults
+// (100ms / 30s / 1s), which is what NewPool() and NewElasticPool() use.
+type MonitorOptions struct {
+	WarnAfter    time.Duration
+	KillAfter    time.Duration
+	PollInterval time.Duration
+	OnStuck      func(tag string, held time.Duration, stack []byte)
+}
+
+// withDefaults returns a copy of o with any zero-valued duration replaced
+// by the package default.
+func (o MonitorOptions) withDefaults() MonitorOptions {
+	if o.WarnAfter <= 0 {
+		o.WarnAfter = defaultWarnAfter
+	}
+
+	if o.KillAfter <= 0 {
+		o.KillAfter = defaultKillAfter
+	}
+
+	if o.PollInterval <= 0 {
+		o.PollInterval = defaultPollInterval
+	}
+
+	return o
+}
+
+// poolMetrics holds the optional Prometheus collectors for a Pool.
+// It is nil unless a prometheus.Registerer was passed to NewPoolWithOptions().
+type poolMetrics struct {
+	acquireTotal  prometheus.Counter
+	releaseTotal  prometheus.Counter
+	overflowTotal prometheus.Counter
+	overflowBytes prometheus.Counter
+	acquireWait   prometheus.Histogram
+	holdDuration  prometheus.Histogram
+}
+
 // Buffer is a wrapper around bytes.Buffer{} and as such implements all the things
 // that bytes.Buffer{} does, including the io.Writer interface.
 // It is not intended to be used directly, but Acquire()d from a Pool.
 type Buffer struct {
 	bytes.Buffer
-	pool         *Pool
-	index        int
-	origSize     int
-	acquiredAt   time.Time
-	tag          string
+	pool       *Pool
+	index      int
+	origSize   int
+	acquiredAt time.Time
+	tag        string
+	stack      []byte // stack of the acquiring goroutine, for stuck-buffer diagnostics
+	released   int32  // CAS-guarded claim: 0 while held, 1 once Release() or poolMonitor's forced reclaim has claimed it
 }
 
 // Release a Buffer back to the Pool it was Acquire()d from.
+// If the Pool currently holds more Buffers than its minCount, the Buffer is
+// instead discarded so its memory can be reclaimed by the GC, shrinking the
+// Pool back towards minCount.
+// If this Buffer was already forcibly reclaimed by poolMonitor for being
+// held past MonitorOptions.KillAfter, Release() is a no-op: the two race to
+// claim eb.released via a single atomic CAS, so only one of them ever hands
+// the Buffer's slot back to the Pool.
 func (eb *Buffer) Release() {
-	if eb.pool == nil {
+	p := eb.pool
+	if p == nil {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&eb.released, 0, 1) {
 		return
 	}
 
+	p.releaseBuffer(eb)
+}
+
+// releaseBuffer returns eb to p, or discards it if p currently holds more
+// live Buffers than minCount. Shared by Buffer.Release() and poolMonitor's
+// stuck-buffer reclamation.
+func (p *Pool) releaseBuffer(eb *Buffer) {
 	// check size
 	if eb.Cap() > eb.origSize {
-		log.Ctx(eb.pool.ctx).Warn().Msgf("Buffer with tag %s allocated %d bytes (%d requested)",
-			eb.tag, eb.Cap(), eb.pool.size)
+		log.Ctx(p.ctx).Warn().Msgf("Buffer with tag %s allocated %d bytes (%d requested)",
+			eb.tag, eb.Cap(), p.size)
+
+		if m := p.metrics; m != nil {
+			m.overflowTotal.Inc()
+			m.overflowBytes.Add(float64(eb.Cap() - eb.origSize))
+		}
 
 		eb.origSize = eb.Cap()
 	}
 
-	eb.pool.lock.Lock()
+	if m := p.metrics; m != nil {
+		m.releaseTotal.Inc()
+		m.holdDuration.Observe(time.Since(eb.acquiredAt).Seconds())
+	}
+
+	p.lock.Lock()
+
+	p.buffersInUse[eb.index] = nil
 
-	eb.pool.buffersInUse[eb.index] = nil
+	overCap := p.liveCount > p.minCount
+	if overCap {
+		p.liveCount--
+	}
 
-	eb.pool.lock.Unlock()
+	p.lock.Unlock()
 
 	eb.index = -1
 	eb.tag = ""
+	eb.stack = nil
 	eb.Reset()
 
-	eb.pool.buffersAvailable <- eb
+	// eb.released is cleared last, only once eb is no longer reachable via
+	// p.buffersInUse, so it is ready to be claimed again the next time this
+	// Buffer is handed out.
+	atomic.StoreInt32(&eb.released, 0)
+
+	if overCap {
+		eb.pool = nil
+	} else {
+		p.buffersAvailable <- eb
+	}
+
+	p.limiter <- struct{}{}
 }
 
-// Pool implements a pool of buffers. Create a new pool using the NewPool() function.
+// Pool implements an elastic pool of buffers. Create a new pool using the
+// NewPool(), NewElasticPool() or NewPoolWithOptions() functions.
+//
+// The Pool eagerly allocates minCount Buffers, and lazily allocates further
+// Buffers on demand up to maxCount. Acquire() only blocks once maxCount
+// Buffers are concurrently in use. Buffers acquired beyond minCount are
+// discarded (rather than pooled) on Release() while the Pool holds more
+// than minCount live Buffers, so memory given back under a burst is
+// reclaimed by the GC instead of being pinned forever.
 type Pool struct {
 	size             int
-	count            int
+	minCount         int
+	maxCount         int
+	liveCount        int // Buffers currently allocated (idle + in use)
 	ctx              context.Context
 	lock             sync.Mutex
 	buffersAvailable chan *Buffer
+	limiter          chan struct{}
 	buffersInUse     []*Buffer
+	closed           chan struct{}
+	metrics          *poolMetrics
 }
 
 // All Buffers should be released as soon as they are not needed.
+// Acquire blocks until a Buffer becomes available, with no time limit; use
+// AcquireContext() to bound how long the caller is prepared to wait.
+// It returns nil if the Pool is Free()d, either before the call or while it
+// waits.
 func (p *Pool) Acquire(tag string) *Buffer {
-	if p.size == 0 || p.count == 0 {
+	eb, err := p.AcquireContext(context.Background(), tag)
+	if err != nil {
 		return nil
 	}
 
-	eb := <-p.buffersAvailable
+	return eb
+}
+
+// AcquireContext behaves like Acquire(), but returns early with ctx.Err()
+// if ctx is cancelled or times out before a Buffer becomes available, and
+// with ErrPoolFreed if the Pool is Free()d while this call is waiting.
+// It only blocks once maxCount Buffers are concurrently in use; below that
+// hard limit, a Buffer is either taken from the idle pool or allocated on
+// the spot.
+func (p *Pool) AcquireContext(ctx context.Context, tag string) (*Buffer, error) {
+	if p.size == 0 || p.maxCount == 0 {
+		return nil, ErrPoolFreed
+	}
+
+	waitStart := time.Now()
+
+	select {
+	case <-p.limiter:
+	case <-p.closed:
+		return nil, ErrPoolFreed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	var eb *Buffer
+
+	select {
+	case eb = <-p.buffersAvailable:
+	default:
+		buf := bytes.Buffer{}
+		buf.Grow(p.size)
+		eb = &Buffer{Buffer: buf, pool: p, origSize: p.size}
+
+		p.lock.Lock()
+		p.liveCount++
+		p.lock.Unlock()
+	}
+
+	if m := p.metrics; m != nil {
+		m.acquireTotal.Inc()
+		m.acquireWait.Observe(time.Since(waitStart).Seconds())
+	}
+
+	// Set every field poolMonitor reads before eb is published via
+	// p.buffersInUse, so poolMonitor never observes a partially-written
+	// Buffer under the lock.
+	eb.tag = tag
+	eb.acquiredAt = time.Now()
+
+	stack := make([]byte, 4096)
+	eb.stack = stack[:runtime.Stack(stack, false)]
 
 	p.lock.Lock()
 
@@ -85,93 +279,238 @@ func (p *Pool) Acquire(tag string) *Buffer {
 
 	p.lock.Unlock()
 
-	eb.tag = tag
-	eb.acquiredAt = time.Now()
-
-	return eb
+	return eb, nil
 }
 
 // Free waits for all Buffers in the Pool to be Release()d and then frees
 // the memory used by the Pool. Technically it just releases
 func (p *Pool) Free() {
-	if p.size == 0 || p.count == 0 {
+	if p.size == 0 || p.maxCount == 0 {
 		return
 	}
 
-	count := p.count
+	maxCount := p.maxCount
 
 	p.lock.Lock()
 
 	// causes the poolMonitor to exit
-	p.count = 0
+	p.maxCount = 0
 
 	p.lock.Unlock()
 
-	// read all buffersAvailable and discard them
-	for i := 0; i < count; i++ {
-		<-p.buffersAvailable
+	// unblock any AcquireContext() calls waiting on the limiter
+	close(p.closed)
+
+	// wait for every acquired Buffer to be Release()d: each Release()
+	// returns its token to the limiter, whether or not the Buffer itself
+	// was kept or discarded.
+	for i := 0; i < maxCount; i++ {
+		<-p.limiter
 	}
 
 	p.buffersInUse = nil
+	p.buffersAvailable = nil
 }
 
-// BuffersAvailable() returns the number of unused Buffers in the Pool.
+// BuffersAvailable() returns the number of Buffers that are currently
+// pooled and idle, i.e. that Acquire() can hand out without allocating new
+// memory. Use Headroom() for the remaining lazily-allocatable capacity.
 func (p *Pool) BuffersAvailable() int {
-	if p.size == 0 || p.count == 0 {
+	if p.size == 0 || p.maxCount == 0 {
 		return 0
 	}
 
-	i := 0
-
-	p.lock.Lock()
+	return len(p.buffersAvailable)
+}
 
-	for _, b := range p.buffersInUse {
-		if b == nil {
-			i++
-		}
+// Headroom returns the number of further Buffers the Pool could still
+// lazily allocate before Acquire() starts blocking on the hard maxCount
+// limit.
+func (p *Pool) Headroom() int {
+	if p.size == 0 || p.maxCount == 0 {
+		return 0
 	}
 
-	p.lock.Unlock()
+	p.lock.Lock()
+	defer p.lock.Unlock()
 
-	return i
+	return p.maxCount - p.liveCount
 }
 
-// NewPool creates a new Pool of Buffers.
+// NewPool creates a new fixed-size Pool of Buffers.
 // It creates count Buffers, of size bytes each.
 // It is possible to write more than the allocate bytes into the buffers, however
 // a warning will be issued when the buffer is released.
 // The context is used for logging.
 // Use Pool.Free() to dispose of the buffer when no longer needed.
+// NewPool is a thin wrapper around NewElasticPool with minCount == maxCount
+// == count; see NewElasticPool for a Pool that can grow under burst load.
 func NewPool(ctx context.Context, count, size int) *Pool {
-	if count <= 0 || size <= 0 {
+	return NewElasticPool(ctx, count, count, size)
+}
+
+// NewElasticPool creates a new Pool that eagerly allocates minCount Buffers
+// of size bytes each, and lazily allocates further Buffers on demand up to
+// maxCount as Acquire() calls outpace the idle pool. Buffers handed out
+// beyond minCount are discarded, rather than pooled, on Release() while the
+// Pool holds more than minCount live Buffers, so burst capacity doesn't
+// permanently pin memory. Acquire() only blocks once maxCount Buffers are
+// concurrently in use.
+func NewElasticPool(ctx context.Context, minCount, maxCount, size int) *Pool {
+	return NewPoolWithOptions(ctx, minCount, maxCount, size, nil, MonitorOptions{})
+}
+
+// NewPoolWithOptions is like NewElasticPool(), but additionally accepts a
+// prometheus.Registerer and MonitorOptions.
+// When reg is non-nil, the Pool registers gauges, counters and histograms
+// describing its utilization: buffers in use, buffers available, total
+// acquires/releases, overflow events and bytes, and acquire wait / hold
+// duration histograms. Pass nil to skip metrics registration.
+// monitorOpts configures poolMonitor's stuck-buffer detection; its zero
+// value uses the package defaults, same as NewElasticPool().
+func NewPoolWithOptions(ctx context.Context, minCount, maxCount, size int, reg prometheus.Registerer,
+	monitorOpts MonitorOptions) *Pool {
+	if minCount < 0 || maxCount <= 0 || minCount > maxCount || size <= 0 {
 		log.Ctx(ctx).Error().Msgf("Invalid arguments in call to NewPool")
 
 		return nil
 	}
 
-	p := Pool{size: size, count: count, ctx: ctx}
+	p := Pool{size: size, minCount: minCount, maxCount: maxCount, ctx: ctx}
+
+	p.buffersInUse = make([]*Buffer, maxCount)
+	p.buffersAvailable = make(chan *Buffer, maxCount)
+	p.limiter = make(chan struct{}, maxCount)
+	p.closed = make(chan struct{})
 
-	p.buffersInUse = make([]*Buffer, count)
-	p.buffersAvailable = make(chan *Buffer, count)
+	for i := 0; i < maxCount; i++ {
+		p.limiter <- struct{}{}
+	}
 
-	for i := 0; i < count; i++ {
+	for i := 0; i < minCount; i++ {
 		buf := bytes.Buffer{}
 		buf.Grow(size)
 		ebuf := Buffer{Buffer: buf, pool: &p, origSize: size}
 		p.buffersAvailable <-&ebuf
 	}
 
-	go p.poolMonitor()
+	p.liveCount = minCount
+
+	p.registerMetrics(reg)
+
+	go p.poolMonitor(monitorOpts.withDefaults())
 
 	return &p
 }
 
-// poolMonitor checks that buffers are released in a timely fashion.
-func (p *Pool) poolMonitor() {
+// registerMetrics creates and registers the Pool's Prometheus collectors
+// with reg. It is a no-op if reg is nil. Gauges read live state under the
+// Pool's lock so that scrapes don't perturb Acquire()/Release() behavior.
+// Every collector carries a "pool" ConstLabel unique to this Pool instance,
+// so that multiple Pools can register with the same Registerer.
+func (p *Pool) registerMetrics(reg prometheus.Registerer) {
+	if reg == nil {
+		return
+	}
+
+	labels := prometheus.Labels{"pool": nextPoolInstanceID()}
+
+	m := &poolMetrics{
+		acquireTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "acquires_total",
+			Help:        "Total number of Buffers acquired from the pool.",
+			ConstLabels: labels,
+		}),
+		releaseTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "releases_total",
+			Help:        "Total number of Buffers released back to the pool.",
+			ConstLabels: labels,
+		}),
+		overflowTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "overflow_total",
+			Help:        "Total number of times a Buffer grew beyond its original size.",
+			ConstLabels: labels,
+		}),
+		overflowBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "overflow_bytes_total",
+			Help:        "Total bytes allocated by Buffers beyond their original size.",
+			ConstLabels: labels,
+		}),
+		acquireWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   metricsNamespace,
+			Name:        "acquire_wait_seconds",
+			Help:        "Time spent waiting in Acquire()/AcquireContext() for a Buffer to become available.",
+			Buckets:     prometheus.DefBuckets,
+			ConstLabels: labels,
+		}),
+		holdDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   metricsNamespace,
+			Name:        "hold_duration_seconds",
+			Help:        "Time a Buffer was held between Acquire() and Release().",
+			Buckets:     prometheus.DefBuckets,
+			ConstLabels: labels,
+		}),
+	}
+
+	buffersInUse := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Name:        "buffers_in_use",
+		Help:        "Number of Buffers currently acquired from the pool.",
+		ConstLabels: labels,
+	}, func() float64 {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		n := 0
+
+		for _, b := range p.buffersInUse {
+			if b != nil {
+				n++
+			}
+		}
+
+		return float64(n)
+	})
+
+	buffersAvailable := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Name:        "buffers_available",
+		Help:        "Number of unused Buffers in the pool.",
+		ConstLabels: labels,
+	}, func() float64 {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		return float64(p.BuffersAvailable())
+	})
+
+	reg.MustRegister(m.acquireTotal, m.releaseTotal, m.overflowTotal, m.overflowBytes,
+		m.acquireWait, m.holdDuration, buffersInUse, buffersAvailable)
+
+	p.metrics = m
+}
+
+// stuckReport carries what poolMonitor needs to call opts.OnStuck for one
+// Buffer, captured while p.lock is held so it can be delivered afterwards.
+type stuckReport struct {
+	tag   string
+	held  time.Duration
+	stack []byte
+}
+
+// poolMonitor checks that buffers are released in a timely fashion. Buffers
+// held past opts.WarnAfter are logged and reported via opts.OnStuck; those
+// held past opts.KillAfter are forcibly reclaimed, with a fresh Buffer put
+// back into the Pool in their place.
+func (p *Pool) poolMonitor(opts MonitorOptions) {
 	for {
 		p.lock.Lock()
 
-		if p.count == 0 {
+		if p.maxCount == 0 {
 			p.lock.Unlock()
 
 			log.Ctx(p.ctx).Debug().Msgf("Buffers.poolMonitor exiting")
@@ -181,17 +520,62 @@ func (p *Pool) poolMonitor() {
 
 		now := time.Now()
 
+		var toReclaim []*Buffer
+		var toWarn []stuckReport
+
 		for _, eb := range p.buffersInUse {
-			if eb != nil {
-				if eb.acquiredAt.Add(100 * time.Millisecond).Before(now) {
-					log.Ctx(p.ctx).Warn().Msgf("Buffer with tag %s held "+
-						"for %v", eb.tag, time.Since(eb.acquiredAt))
+			if eb == nil {
+				continue
+			}
+
+			held := now.Sub(eb.acquiredAt)
+
+			if held >= opts.KillAfter {
+				// Claim eb before touching it further: a concurrent
+				// Release() may be racing to claim the same Buffer, and
+				// whichever of the two loses must leave it alone entirely.
+				if !atomic.CompareAndSwapInt32(&eb.released, 0, 1) {
+					continue
+				}
+
+				log.Ctx(p.ctx).Error().Msgf("Buffer with tag %s held for %v, forcibly reclaiming",
+					eb.tag, held)
+
+				toReclaim = append(toReclaim, eb)
+
+				continue
+			}
+
+			if held >= opts.WarnAfter {
+				log.Ctx(p.ctx).Warn().Msgf("Buffer with tag %s held for %v", eb.tag, held)
+
+				if opts.OnStuck != nil {
+					toWarn = append(toWarn, stuckReport{tag: eb.tag, held: held, stack: eb.stack})
 				}
 			}
 		}
 
 		p.lock.Unlock()
 
-		time.Sleep(1 * time.Second)
+		// opts.OnStuck is arbitrary caller code, and releaseBuffer() takes
+		// p.lock itself, so both must run outside the loop above: calling
+		// either while still holding p.lock would stall or deadlock every
+		// other goroutine using the Pool.
+		for _, r := range toWarn {
+			opts.OnStuck(r.tag, r.held, r.stack)
+		}
+
+		for _, eb := range toReclaim {
+			// eb itself stays claimed (eb.released == 1) for good, so a late
+			// Release() by its original holder is a no-op. A fresh Buffer
+			// takes over eb's slot and is what goes back into the Pool.
+			fresh := &Buffer{pool: p, index: eb.index, acquiredAt: eb.acquiredAt, released: 1}
+			fresh.Grow(eb.origSize)
+			fresh.origSize = fresh.Cap()
+
+			p.releaseBuffer(fresh)
+		}
+
+		time.Sleep(opts.PollInterval)
 	}
 }
@@ -13,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
@@ -90,6 +91,207 @@ func TestAcquireRelease(t *testing.T) {
 	pool.Free()
 }
 
+func TestAcquireContextTimeout(t *testing.T) {
+	pool := ephemeral_buffers.NewPool(logCtx, 1, 1000)
+
+	b0 := pool.Acquire("TestAcquireContextTimeout")
+
+	ctx, cancel := context.WithTimeout(logCtx, 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := pool.AcquireContext(ctx, "TestAcquireContextTimeout"); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	b0.Release()
+
+	pool.Free()
+}
+
+func TestAcquireContextPoolFreed(t *testing.T) {
+	pool := ephemeral_buffers.NewPool(logCtx, 1, 1000)
+
+	b0 := pool.Acquire("TestAcquireContextPoolFreed")
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := pool.AcquireContext(context.Background(), "TestAcquireContextPoolFreed")
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	go pool.Free()
+
+	if err := <-done; err != ephemeral_buffers.ErrPoolFreed {
+		t.Errorf("expected ErrPoolFreed, got %v", err)
+	}
+
+	b0.Release()
+}
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	pool := ephemeral_buffers.NewPoolWithOptions(logCtx, 1, 1, 16, reg, ephemeral_buffers.MonitorOptions{})
+
+	buf := pool.Acquire("TestMetrics")
+	buf.Write([]byte("this string does not fit in 16 bytes and forces a reallocation"))
+	buf.Release()
+
+	metricFamilies, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() failed: %v", err)
+	}
+
+	if len(metricFamilies) == 0 {
+		t.Errorf("expected metrics to be registered")
+	}
+
+	pool.Free()
+}
+
+func TestMetricsMultiplePools(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	pool1 := ephemeral_buffers.NewPoolWithOptions(logCtx, 1, 1, 16, reg, ephemeral_buffers.MonitorOptions{})
+	pool2 := ephemeral_buffers.NewPoolWithOptions(logCtx, 1, 1, 16, reg, ephemeral_buffers.MonitorOptions{})
+
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("Gather() failed: %v", err)
+	}
+
+	pool1.Free()
+	pool2.Free()
+}
+
+func TestElasticPool(t *testing.T) {
+	minCount := 2
+	maxCount := 5
+	size := 1000
+
+	pool := ephemeral_buffers.NewElasticPool(logCtx, minCount, maxCount, size)
+
+	if pool.BuffersAvailable() != minCount {
+		t.Errorf("expected %d idle buffers, got %d", minCount, pool.BuffersAvailable())
+	}
+
+	if pool.Headroom() != maxCount-minCount {
+		t.Errorf("expected %d headroom, got %d", maxCount-minCount, pool.Headroom())
+	}
+
+	buffers := []*ephemeral_buffers.Buffer{}
+
+	for i := 0; i < maxCount; i++ {
+		b := pool.Acquire("TestElasticPool")
+		if b == nil {
+			t.Fatalf("Acquire() returned nil before reaching maxCount")
+		}
+
+		buffers = append(buffers, b)
+	}
+
+	if pool.Headroom() != 0 {
+		t.Errorf("expected 0 headroom at maxCount, got %d", pool.Headroom())
+	}
+
+	ctx, cancel := context.WithTimeout(logCtx, 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := pool.AcquireContext(ctx, "TestElasticPool"); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded at hard limit, got %v", err)
+	}
+
+	for _, b := range buffers {
+		b.Release()
+	}
+
+	if pool.BuffersAvailable() != minCount {
+		t.Errorf("expected pool to shrink back to %d idle buffers, got %d", minCount, pool.BuffersAvailable())
+	}
+
+	pool.Free()
+}
+
+func TestStuckBufferReclaimed(t *testing.T) {
+	type stuckReport struct {
+		tag   string
+		held  time.Duration
+		stack []byte
+	}
+
+	reports := make(chan stuckReport, 10)
+
+	opts := ephemeral_buffers.MonitorOptions{
+		WarnAfter:    10 * time.Millisecond,
+		KillAfter:    100 * time.Millisecond,
+		PollInterval: 20 * time.Millisecond,
+		OnStuck: func(tag string, held time.Duration, stack []byte) {
+			reports <- stuckReport{tag: tag, held: held, stack: stack}
+		},
+	}
+
+	pool := ephemeral_buffers.NewPoolWithOptions(logCtx, 1, 1, 1000, nil, opts)
+
+	pool.Acquire("TestStuckBufferReclaimed")
+
+	report := <-reports
+
+	if report.tag != "TestStuckBufferReclaimed" {
+		t.Errorf("unexpected tag in OnStuck report: %s", report.tag)
+	}
+
+	if len(report.stack) == 0 {
+		t.Errorf("expected a non-empty stack trace in OnStuck report")
+	}
+
+	// the Pool should forcibly reclaim the leaked buffer once KillAfter
+	// elapses, so a second Acquire() should not block forever.
+	b := pool.Acquire("TestStuckBufferReclaimed2")
+	if b == nil {
+		t.Fatalf("expected the reclaimed buffer to be handed back out")
+	}
+
+	b.Release()
+
+	pool.Free()
+}
+
+func TestConcurrentReleaseVsReclaim(t *testing.T) {
+	opts := ephemeral_buffers.MonitorOptions{
+		WarnAfter:    time.Millisecond,
+		KillAfter:    2 * time.Millisecond,
+		PollInterval: time.Millisecond,
+	}
+
+	// Race a legitimate Release() against poolMonitor's forced reclaim of
+	// the same Buffer, repeatedly, to catch the double-releaseBuffer()
+	// regression (panic: index out of range [-1]) that an unguarded
+	// read-then-act claim allowed.
+	for i := 0; i < 200; i++ {
+		pool := ephemeral_buffers.NewPoolWithOptions(logCtx, 1, 1, 16, nil, opts)
+
+		b := pool.Acquire("TestConcurrentReleaseVsReclaim")
+
+		done := make(chan struct{})
+
+		go func() {
+			time.Sleep(2 * time.Millisecond)
+			b.Release()
+			close(done)
+		}()
+
+		<-done
+
+		// give poolMonitor a chance to also act on the same Buffer before
+		// we tear the pool down
+		time.Sleep(3 * time.Millisecond)
+
+		pool.Free()
+	}
+}
+
 func TestOverflow(t *testing.T) {
 	pool := ephemeral_buffers.NewPool(logCtx, 1, 1024)
 
@@ -0,0 +1,90 @@
+/**
+ * Copyright (c) 2021, Xerra Earth Observation Institute
+ * All rights reserved. Use is subject to License terms.
+ * See LICENSE.TXT in the root directory of this source tree.
+ */
+
+package ephemeral_buffers
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SizedPool manages several Pools bucketed by power-of-two buffer sizes, and
+// hands out a Buffer from the smallest bucket that can hold a given size
+// hint without growing. This avoids the largest bucket being wasted on
+// small payloads, and avoids the silent-warn-and-grow behaviour of a single
+// Pool when callers know roughly how big a Buffer they need.
+type SizedPool struct {
+	ctx   context.Context
+	pools []*Pool // ascending by bucket size
+}
+
+// NewSizedPool creates a SizedPool with one Pool bucket per power of two
+// from minSize up to maxSize, both rounded up to the nearest power of two.
+// Each bucket is itself an elastic Pool, eagerly allocating minCount
+// Buffers and growing on demand up to maxCount; see NewElasticPool.
+// Use SizedPool.Free() to dispose of all buckets when no longer needed.
+func NewSizedPool(ctx context.Context, minCount, maxCount, minSize, maxSize int) *SizedPool {
+	if minSize <= 0 || maxSize < minSize {
+		log.Ctx(ctx).Error().Msgf("Invalid arguments in call to NewSizedPool")
+
+		return nil
+	}
+
+	sp := SizedPool{ctx: ctx}
+
+	for bucketSize := nextPowerOfTwo(minSize); bucketSize <= nextPowerOfTwo(maxSize); bucketSize *= 2 {
+		bucket := NewElasticPool(ctx, minCount, maxCount, bucketSize)
+		if bucket == nil {
+			return nil
+		}
+
+		sp.pools = append(sp.pools, bucket)
+	}
+
+	return &sp
+}
+
+// Acquire returns a Buffer from the smallest bucket whose size is at least
+// sizeHint. Release() routes the Buffer back to the bucket it came from, so
+// callers use it exactly like a Buffer Acquire()d from a plain Pool.
+// If sizeHint exceeds the largest bucket, a standalone Buffer is
+// heap-allocated instead; it is not pooled, so Release() just discards it.
+func (sp *SizedPool) Acquire(tag string, sizeHint int) *Buffer {
+	for _, p := range sp.pools {
+		if p.size >= sizeHint {
+			return p.Acquire(tag)
+		}
+	}
+
+	log.Ctx(sp.ctx).Warn().Msgf("SizedPool has no bucket large enough for %d bytes, "+
+		"allocating a standalone Buffer", sizeHint)
+
+	buf := bytes.Buffer{}
+	buf.Grow(sizeHint)
+
+	return &Buffer{Buffer: buf, origSize: sizeHint, tag: tag, acquiredAt: time.Now()}
+}
+
+// Free disposes of every bucket Pool; see Pool.Free().
+func (sp *SizedPool) Free() {
+	for _, p := range sp.pools {
+		p.Free()
+	}
+}
+
+// nextPowerOfTwo returns the smallest power of two that is >= n.
+func nextPowerOfTwo(n int) int {
+	p := 1
+
+	for p < n {
+		p *= 2
+	}
+
+	return p
+}
@@ -0,0 +1,59 @@
+/**
+ * Copyright (c) 2021, Xerra Earth Observation Institute
+ * All rights reserved. Use is subject to License terms.
+ * See LICENSE.TXT in the root directory of this source tree.
+ */
+
+package ephemeral_buffers_test
+
+import (
+	"testing"
+
+	"gitlab.com/xerra/common/ephemeral_buffers"
+)
+
+func TestSizedPoolBucketing(t *testing.T) {
+	pool := ephemeral_buffers.NewSizedPool(logCtx, 1, 2, 64, 256)
+
+	b := pool.Acquire("TestSizedPoolBucketing", 100)
+	if b.Cap() != 128 {
+		t.Errorf("expected a 128 byte bucket for a 100 byte hint, got %d", b.Cap())
+	}
+
+	b.Release()
+
+	pool.Free()
+}
+
+func TestSizedPoolReachesMaxSize(t *testing.T) {
+	pool := ephemeral_buffers.NewSizedPool(logCtx, 1, 1, 1, 100)
+
+	b := pool.Acquire("TestSizedPoolReachesMaxSize", 100)
+	if b.Cap() != 128 {
+		t.Errorf("expected the 100 byte hint to fit in the 128 byte bucket (2^7 >= 100), got %d", b.Cap())
+	}
+
+	b.Release()
+
+	pool.Free()
+}
+
+func TestSizedPoolInvalidArgs(t *testing.T) {
+	if pool := ephemeral_buffers.NewSizedPool(logCtx, 2, 1, 64, 256); pool != nil {
+		t.Errorf("expected nil SizedPool for an invalid minCount/maxCount combination")
+	}
+}
+
+func TestSizedPoolFallback(t *testing.T) {
+	pool := ephemeral_buffers.NewSizedPool(logCtx, 1, 2, 64, 256)
+
+	b := pool.Acquire("TestSizedPoolFallback", 1000)
+	if b.Cap() < 1000 {
+		t.Errorf("expected a standalone Buffer with at least 1000 bytes capacity, got %d", b.Cap())
+	}
+
+	b.Write([]byte("not pooled, just released"))
+	b.Release()
+
+	pool.Free()
+}